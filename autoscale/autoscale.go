@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +18,6 @@ import (
 	"github.com/tsuru/tsuru/app"
 	tsuruErrors "github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/event"
-	"github.com/tsuru/tsuru/iaas"
 	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/net"
 	"github.com/tsuru/tsuru/permission"
@@ -36,6 +36,7 @@ type Config struct {
 	WaitTimeNewMachine  time.Duration
 	RunInterval         time.Duration
 	TotalMemoryMetadata string
+	TotalCPUMetadata    string
 	done                chan bool
 	writer              io.Writer
 	running             bool
@@ -65,8 +66,10 @@ func newConfig() *Config {
 	waitSecondsNewMachine, _ := config.GetInt("docker:auto-scale:wait-new-time")
 	runInterval, _ := config.GetInt("docker:auto-scale:run-interval")
 	totalMemoryMetadata, _ := config.GetString("docker:scheduler:total-memory-metadata")
+	totalCPUMetadata, _ := config.GetString("docker:scheduler:total-cpu-metadata")
 	c := &Config{
 		TotalMemoryMetadata: totalMemoryMetadata,
+		TotalCPUMetadata:    totalCPUMetadata,
 		WaitTimeNewMachine:  time.Duration(waitSecondsNewMachine) * time.Second,
 		RunInterval:         time.Duration(runInterval) * time.Second,
 		done:                make(chan bool),
@@ -77,6 +80,7 @@ func newConfig() *Config {
 	if c.WaitTimeNewMachine == 0 {
 		c.WaitTimeNewMachine = 5 * time.Minute
 	}
+	configureDecisionSink()
 	return c
 }
 
@@ -93,6 +97,14 @@ type ScalerResult struct {
 	ToRemove    []provision.NodeSpec
 	ToRebalance bool
 	Reason      string
+	// PeersConsulted lists the peers (see Peer) whose reported spare
+	// capacity was taken into account for this decision, set only for
+	// rules with SharedAcrossPeers enabled.
+	PeersConsulted []string
+	// RebalancePlan is the move plan computed for this pool, if any.
+	// It's populated even when ToRebalance ends up false, so operators
+	// can inspect what a rebalance would have done.
+	RebalancePlan *RebalancePlan
 }
 
 func (r *ScalerResult) IsRebalanceOnly() bool {
@@ -108,6 +120,9 @@ type autoScaler interface {
 }
 
 func (a *Config) scalerForRule(rule *Rule) (autoScaler, error) {
+	if rule.QueueMode {
+		return &queueScaler{Config: a, rule: rule}, nil
+	}
 	if rule.MaxContainerCount > 0 {
 		return &countScaler{Config: a, rule: rule}, nil
 	}
@@ -140,6 +155,13 @@ func (a *Config) logDebug(msg string, params ...interface{}) {
 	log.Debugf(msg, params...)
 }
 
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 func (a *Config) runOnce() error {
 	err := a.runScaler()
 	if err != nil {
@@ -167,6 +189,7 @@ func (a *Config) runScaler() (retErr error) {
 			retErr = errors.Errorf("recovered panic, we can never stop! panic: %v", r)
 		}
 	}()
+	a.fixStaleLocks()
 	provs, err := provision.Registry()
 	if err != nil {
 		return errors.Wrap(err, "error getting provisioners")
@@ -219,12 +242,15 @@ func nodesToSpec(nodes []provision.Node) []provision.NodeSpec {
 }
 
 func (a *Config) runScalerInNodes(prov provision.NodeProvisioner, pool string, nodes []provision.Node) {
+	runsTotal.WithLabelValues(pool).Inc()
 	evt, err := event.NewInternal(&event.Opts{
 		Target:       event.Target{Type: event.TargetTypePool, Value: pool},
 		InternalKind: EventKind,
 		Allowed:      event.Allowed(permission.PermPoolReadEvents, permission.Context(permission.CtxPool, pool)),
 	})
 	if err != nil {
+		errorsTotal.WithLabelValues(pool, errorKind(err)).Inc()
+		logDecision(DecisionRecord{Time: time.Now(), Pool: pool, NodeCount: len(nodes), Error: err.Error()})
 		if _, ok := err.(event.ErrEventLocked); ok {
 			a.logDebug("skipping already running for: %s", pool)
 		} else {
@@ -237,10 +263,21 @@ func (a *Config) runScalerInNodes(prov provision.NodeProvisioner, pool string, n
 	var sResult *ScalerResult
 	var evtNodes []provision.NodeSpec
 	var rule *Rule
+	unitGap := 0
 	defer func() {
 		if retErr != nil {
+			errorsTotal.WithLabelValues(pool, errorKind(retErr)).Inc()
 			evt.Logf(retErr.Error())
 		}
+		logDecision(DecisionRecord{
+			Time:      time.Now(),
+			Pool:      pool,
+			Rule:      rule,
+			NodeCount: len(nodes),
+			UnitGap:   unitGap,
+			Result:    sResult,
+			Error:     errString(retErr),
+		})
 		if (sResult == nil && retErr == nil) || (sResult != nil && sResult.NoAction()) {
 			evt.Logf("nothing to do for %q: %q", provision.PoolMetadataName, pool)
 			evt.Abort()
@@ -277,15 +314,29 @@ func (a *Config) runScalerInNodes(prov provision.NodeProvisioner, pool string, n
 	sResult, err = scaler.scale(pool, nodes)
 	if err != nil {
 		if _, ok := err.(errAppNotLocked); ok {
-			evt.Logf("aborting scaler for now, gonna retry later: %s", err)
+			retErr = errors.Wrapf(err, "aborting scaler for now, gonna retry later for %s", pool)
 			return
 		}
 		retErr = errors.Wrapf(err, "error scaling group %s", pool)
 		return
 	}
+	if _, gap, gapErr := unitsGapInNodes(pool, nodes); gapErr == nil {
+		unitGap = gap
+	}
+	if sResult.ToAdd > 0 && rule.SharedAcrossPeers {
+		excess, consulted := a.peerExcessCapacity(pool, rule)
+		sResult.PeersConsulted = consulted
+		if excess > 0 {
+			evt.Logf("peers %v report %d spare units for %q, reducing scale-up", consulted, excess, pool)
+			sResult.ToAdd -= excess
+			if sResult.ToAdd < 0 {
+				sResult.ToAdd = 0
+			}
+		}
+	}
 	if sResult.ToAdd > 0 {
 		evt.Logf("running event \"add\" for %q: %#v", pool, sResult)
-		evtNodes, err = a.addMultipleNodes(evt, prov, nodes, sResult.ToAdd)
+		evtNodes, err = a.addMultipleNodes(evt, prov, pool, nodes, sResult.ToAdd)
 		if err != nil {
 			if len(evtNodes) == 0 {
 				retErr = err
@@ -296,14 +347,14 @@ func (a *Config) runScalerInNodes(prov provision.NodeProvisioner, pool string, n
 	} else if len(sResult.ToRemove) > 0 {
 		evt.Logf("running event \"remove\" for %q: %#v", pool, sResult)
 		evtNodes = sResult.ToRemove
-		err = a.removeMultipleNodes(evt, prov, sResult.ToRemove)
+		err = a.removeMultipleNodes(evt, prov, pool, sResult.ToRemove)
 		if err != nil {
 			retErr = err
 			return
 		}
 	}
 	if !rule.PreventRebalance {
-		err := a.rebalanceIfNeeded(evt, prov, pool, nodes, sResult)
+		err := a.rebalanceIfNeeded(evt, prov, pool, rule, nodes, sResult)
 		if err != nil {
 			if sResult.IsRebalanceOnly() {
 				retErr = err
@@ -314,7 +365,7 @@ func (a *Config) runScalerInNodes(prov provision.NodeProvisioner, pool string, n
 	}
 }
 
-func (a *Config) rebalanceIfNeeded(evt *event.Event, prov provision.NodeProvisioner, pool string, nodes []provision.Node, sResult *ScalerResult) error {
+func (a *Config) rebalanceIfNeeded(evt *event.Event, prov provision.NodeProvisioner, pool string, rule *Rule, nodes []provision.Node, sResult *ScalerResult) error {
 	if len(sResult.ToRemove) > 0 {
 		return nil
 	}
@@ -322,8 +373,35 @@ func (a *Config) rebalanceIfNeeded(evt *event.Event, prov provision.NodeProvisio
 	if !ok {
 		return nil
 	}
+	start := time.Now()
+	defer observeDuration(rebalanceDuration, pool, start)
+	plan, err := a.computeRebalancePlan(pool, rule, nodes)
+	if err != nil {
+		return errors.Wrap(err, "unable to compute rebalance plan")
+	}
+	sResult.RebalancePlan = plan
+	if len(plan.Moves) == 0 {
+		evt.Logf("rebalance plan for %q has no moves, skipping", pool)
+		return nil
+	}
+	evt.Logf("rebalance plan for %q: %d moves (max/min gap %.2f/%.2f)", pool, len(plan.Moves), plan.MaxLoad, plan.MinLoad)
 	buf := safe.NewBuffer(nil)
 	writer := io.MultiWriter(buf, evt)
+	if mover, ok := prov.(NodeUnitMover); ok {
+		var moveErrs []string
+		for _, move := range plan.Moves {
+			evt.Logf("moving unit %s from %s to %s", move.Unit.ID, move.FromNode, move.ToNode)
+			if err := mover.MoveUnit(move.Unit, move.FromNode, move.ToNode, writer); err != nil {
+				moveErrs = append(moveErrs, errors.Wrapf(err, "unable to move unit %s", move.Unit.ID).Error())
+			}
+		}
+		sResult.ToRebalance = true
+		if len(moveErrs) > 0 {
+			return errors.Errorf("unable to apply %d/%d rebalance moves: %s", len(moveErrs), len(plan.Moves), strings.Join(moveErrs, "; "))
+		}
+		return nil
+	}
+	evt.Logf("provisioner %T has no per-unit move support, falling back to a full RebalanceNodes call for %q", prov, pool)
 	shouldRebalance, err := rebalanceProv.RebalanceNodes(provision.RebalanceNodesOptions{
 		Force:          false,
 		MetadataFilter: map[string]string{provision.PoolMetadataName: pool},
@@ -336,7 +414,21 @@ func (a *Config) rebalanceIfNeeded(evt *event.Event, prov provision.NodeProvisio
 	return nil
 }
 
-func (a *Config) addMultipleNodes(evt *event.Event, prov provision.NodeProvisioner, modelNodes []provision.Node, count int) ([]provision.NodeSpec, error) {
+// NodeUnitMover is implemented by provisioners that can move a single
+// unit between two nodes. When the concrete provisioner behind
+// NodeRebalanceProvisioner also implements this, rebalanceIfNeeded
+// drives the plan computed by computeRebalancePlan directly, move by
+// move, instead of delegating the whole decision back to the
+// provisioner's opaque RebalanceNodes.
+type NodeUnitMover interface {
+	MoveUnit(unit provision.Unit, fromNode, toNode string, writer io.Writer) error
+}
+
+func (a *Config) addMultipleNodes(evt *event.Event, prov provision.NodeProvisioner, pool string, modelNodes []provision.Node, count int) ([]provision.NodeSpec, error) {
+	driver, err := a.driverForPool(pool)
+	if err != nil {
+		return nil, err
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(count)
 	nodesCh := make(chan provision.Node, count)
@@ -344,7 +436,7 @@ func (a *Config) addMultipleNodes(evt *event.Event, prov provision.NodeProvision
 	for i := 0; i < count; i++ {
 		go func() {
 			defer wg.Done()
-			node, err := a.addNode(evt, prov, modelNodes)
+			node, err := a.addNode(evt, driver, prov, pool, modelNodes)
 			if err != nil {
 				errCh <- err
 				return
@@ -359,19 +451,18 @@ func (a *Config) addMultipleNodes(evt *event.Event, prov provision.NodeProvision
 	for n := range nodesCh {
 		nodes = append(nodes, provision.NodeToSpec(n))
 	}
+	nodesAddedTotal.WithLabelValues(pool).Add(float64(len(nodes)))
 	return nodes, <-errCh
 }
 
-func (a *Config) addNode(evt *event.Event, prov provision.NodeProvisioner, modelNodes []provision.Node) (provision.Node, error) {
+func (a *Config) addNode(evt *event.Event, driver InstanceDriver, prov provision.NodeProvisioner, pool string, modelNodes []provision.Node) (provision.Node, error) {
+	start := time.Now()
+	defer observeDuration(nodeCreateDuration, pool, start)
 	metadata, err := chooseMetadataFromNodes(modelNodes)
 	if err != nil {
 		return nil, err
 	}
-	_, hasIaas := metadata["iaas"]
-	if !hasIaas {
-		return nil, errors.Errorf("no IaaS information in nodes metadata: %#v", metadata)
-	}
-	machine, err := iaas.CreateMachineForIaaS(metadata["iaas"], metadata)
+	machine, err := driver.Create(metadata)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create machine")
 	}
@@ -397,16 +488,10 @@ func (a *Config) addNode(evt *event.Event, prov provision.NodeProvisioner, model
 	return node, nil
 }
 
-func (a *Config) removeMultipleNodes(evt *event.Event, prov provision.NodeProvisioner, chosenNodes []provision.NodeSpec) error {
-	nodeAddrs := make([]string, len(chosenNodes))
-	nodeHosts := make([]string, len(chosenNodes))
-	for i, node := range chosenNodes {
-		_, hasIaas := node.Metadata["iaas"]
-		if !hasIaas {
-			return errors.Errorf("no IaaS information in node (%s) metadata: %#v", node.Address, node.Metadata)
-		}
-		nodeAddrs[i] = node.Address
-		nodeHosts[i] = net.URLToHost(node.Address)
+func (a *Config) removeMultipleNodes(evt *event.Event, prov provision.NodeProvisioner, pool string, chosenNodes []provision.NodeSpec) error {
+	driver, err := a.driverForPool(pool)
+	if err != nil {
+		return err
 	}
 	errCh := make(chan error, len(chosenNodes))
 	wg := sync.WaitGroup{}
@@ -425,12 +510,12 @@ func (a *Config) removeMultipleNodes(evt *event.Event, prov provision.NodeProvis
 				errCh <- errors.Wrapf(err, "unable to unregister node %s for removal", node.Address)
 				return
 			}
-			m, err := iaas.FindMachineByIdOrAddress(node.Metadata["iaas-id"], net.URLToHost(node.Address))
+			m, err := findDriverMachine(driver, node.Metadata["iaas-id"], net.URLToHost(node.Address))
 			if err != nil {
-				evt.Logf("unable to find machine for removal in iaas: %s", err)
+				evt.Logf("unable to find machine for removal in %T: %s", driver, err)
 				return
 			}
-			err = m.Destroy()
+			err = driver.Destroy(m)
 			if err != nil {
 				evt.Logf("unable to destroy machine in IaaS: %s", err)
 			}
@@ -438,6 +523,7 @@ func (a *Config) removeMultipleNodes(evt *event.Event, prov provision.NodeProvis
 	}
 	wg.Wait()
 	close(errCh)
+	nodesRemovedTotal.WithLabelValues(pool).Add(float64(len(chosenNodes)))
 	multiErr := tsuruErrors.NewMultiError()
 	for err := range errCh {
 		multiErr.Add(err)
@@ -0,0 +1,120 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+)
+
+// DecisionRecord is one line of the structured autoscale decision log: a
+// machine-readable counterpart to the evt.Logf free-text trail, with
+// enough inputs and outcome to build dashboards and alerting on top of.
+type DecisionRecord struct {
+	Time      time.Time     `json:"time"`
+	Pool      string        `json:"pool"`
+	Rule      *Rule         `json:"rule,omitempty"`
+	NodeCount int           `json:"nodeCount"`
+	UnitGap   int           `json:"unitGap"`
+	Result    *ScalerResult `json:"result,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// decisionSink is where DecisionRecords are written. It's deliberately
+// narrow so both the file and webhook sinks (and tests) can implement
+// it trivially.
+type decisionSink interface {
+	write(DecisionRecord)
+}
+
+var (
+	decisionSinkMu sync.RWMutex
+	activeSink     decisionSink
+)
+
+// configureDecisionSink reads docker:auto-scale:decision-log:file and
+// docker:auto-scale:decision-log:webhook and wires up the configured
+// sink. It's safe to call repeatedly; the most recent configuration
+// wins. Decision logging is entirely optional: with neither key set, no
+// sink is configured and logDecision becomes a no-op.
+func configureDecisionSink() {
+	decisionSinkMu.Lock()
+	defer decisionSinkMu.Unlock()
+	if path, _ := config.GetString("docker:auto-scale:decision-log:file"); path != "" {
+		activeSink = &fileDecisionSink{path: path}
+		return
+	}
+	if url, _ := config.GetString("docker:auto-scale:decision-log:webhook"); url != "" {
+		activeSink = &webhookDecisionSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+		return
+	}
+	activeSink = nil
+}
+
+func logDecision(rec DecisionRecord) {
+	decisionSinkMu.RLock()
+	sink := activeSink
+	decisionSinkMu.RUnlock()
+	if sink == nil {
+		return
+	}
+	sink.write(rec)
+}
+
+type fileDecisionSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileDecisionSink) write(rec DecisionRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("[node autoscale] unable to marshal decision log record: %s", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("[node autoscale] unable to open decision log file %q: %s", s.path, err)
+		return
+	}
+	defer f.Close()
+	data = append(data, '\n')
+	if _, err = f.Write(data); err != nil {
+		log.Errorf("[node autoscale] unable to write decision log record: %s", err)
+	}
+}
+
+type webhookDecisionSink struct {
+	url    string
+	client *http.Client
+}
+
+// write posts rec to the configured webhook in its own goroutine. The
+// scaler loop calls this once per pool per run, and a slow or unreachable
+// webhook endpoint must never hold up the next pool's scaling decision.
+func (s *webhookDecisionSink) write(rec DecisionRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("[node autoscale] unable to marshal decision log record: %s", err)
+		return
+	}
+	go func() {
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("[node autoscale] unable to post decision log record: %s", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/iaas"
+	"github.com/tsuru/tsuru/net"
+)
+
+// InstanceDriver isolates the autoscaler from the quirks of any single
+// IaaS provider. Providers such as EC2, GCE, Azure or DigitalOcean are
+// expected to register a factory under a unique name, so operators can
+// pick one per pool through configuration instead of the autoscaler
+// always going through the generic iaas package.
+type InstanceDriver interface {
+	Create(metadata map[string]string) (*iaas.Machine, error)
+	Destroy(m *iaas.Machine) error
+	List() ([]iaas.Machine, error)
+	Stop(m *iaas.Machine) error
+	SetTags(m *iaas.Machine, tags map[string]string) error
+}
+
+// InstanceDriverFactory builds a new InstanceDriver instance. Factories
+// are called once per driverForPool lookup, so implementations should be
+// cheap to construct.
+type InstanceDriverFactory func() (InstanceDriver, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]InstanceDriverFactory{}
+)
+
+// RegisterInstanceDriver makes an InstanceDriver implementation available
+// under name. It's meant to be called from init() functions of provider
+// specific packages. Registering a name twice overwrites the previous
+// factory, mirroring how other tsuru registries (provisioners, iaas
+// providers) behave.
+func RegisterInstanceDriver(name string, factory InstanceDriverFactory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[name] = factory
+}
+
+func getInstanceDriver(name string) (InstanceDriver, error) {
+	driversMu.RLock()
+	factory, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("instance driver %q is not registered", name)
+	}
+	return factory()
+}
+
+func init() {
+	RegisterInstanceDriver("iaas", func() (InstanceDriver, error) {
+		return &iaasInstanceDriver{}, nil
+	})
+	// The fake driver is registered as a single shared instance, not a
+	// fresh one per factory call: it stands in for real infrastructure
+	// that persists across scaler cycles, so a machine created in one
+	// run must still be there for addMultipleNodes/removeMultipleNodes
+	// to find in the next one.
+	fake := NewFakeInstanceDriver()
+	RegisterInstanceDriver("fake", func() (InstanceDriver, error) {
+		return fake, nil
+	})
+}
+
+// iaasInstanceDriver is the default driver. It delegates to the generic
+// iaas package, which already talks to EC2, GCE, Azure, DigitalOcean and
+// other providers through their docker-machine style implementations.
+// It exists so that pools with no driver configured keep the historical
+// behavior.
+type iaasInstanceDriver struct{}
+
+func (d *iaasInstanceDriver) Create(metadata map[string]string) (*iaas.Machine, error) {
+	iaasName, ok := metadata["iaas"]
+	if !ok {
+		return nil, errors.Errorf("no IaaS information in nodes metadata: %#v", metadata)
+	}
+	return iaas.CreateMachineForIaaS(iaasName, metadata)
+}
+
+func (d *iaasInstanceDriver) Destroy(m *iaas.Machine) error {
+	return m.Destroy()
+}
+
+func (d *iaasInstanceDriver) List() ([]iaas.Machine, error) {
+	return iaas.ListMachines()
+}
+
+func (d *iaasInstanceDriver) Stop(m *iaas.Machine) error {
+	return errors.Errorf("iaas driver does not support stopping machines, destroy %q instead", m.Id)
+}
+
+func (d *iaasInstanceDriver) SetTags(m *iaas.Machine, tags map[string]string) error {
+	return errors.Errorf("iaas driver does not support tagging machine %q", m.Id)
+}
+
+// driverForPool returns the InstanceDriver configured for pool, falling
+// back to the global default driver and then to the iaas driver so
+// existing deployments keep working without any configuration changes.
+func (a *Config) driverForPool(pool string) (InstanceDriver, error) {
+	name, _ := config.GetString("docker:auto-scale:driver:pools:" + pool)
+	if name == "" {
+		name, _ = config.GetString("docker:auto-scale:driver")
+	}
+	if name == "" {
+		name = "iaas"
+	}
+	return getInstanceDriver(name)
+}
+
+// findDriverMachine looks up a machine previously created by driver,
+// matching by iaas id or by node address. It always goes through
+// driver.List(), never through the built-in iaas package directly, so
+// drivers other than the default one (including FakeInstanceDriver) can
+// be used to manage the full node lifecycle, not just creation.
+func findDriverMachine(driver InstanceDriver, iaasID, host string) (*iaas.Machine, error) {
+	machines, err := driver.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range machines {
+		m := &machines[i]
+		if iaasID != "" && m.Id == iaasID {
+			return m, nil
+		}
+		if net.URLToHost(m.Address) == host {
+			return m, nil
+		}
+	}
+	return nil, errors.Errorf("machine not found for iaas id %q / host %q", iaasID, host)
+}
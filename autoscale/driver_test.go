@@ -0,0 +1,102 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import "testing"
+
+func TestFakeInstanceDriverLifecycle(t *testing.T) {
+	driver := NewFakeInstanceDriver()
+	m, err := driver.Create(map[string]string{"pool": "mypool"})
+	if err != nil {
+		t.Fatalf("unexpected error creating machine: %s", err)
+	}
+	machines, err := driver.List()
+	if err != nil {
+		t.Fatalf("unexpected error listing machines: %s", err)
+	}
+	if len(machines) != 1 || machines[0].Id != m.Id {
+		t.Fatalf("expected List to return the created machine, got %#v", machines)
+	}
+	if err = driver.SetTags(m, map[string]string{"owner": "autoscale"}); err != nil {
+		t.Fatalf("unexpected error setting tags: %s", err)
+	}
+	if err = driver.Stop(m); err != nil {
+		t.Fatalf("unexpected error stopping machine: %s", err)
+	}
+	if err = driver.Destroy(m); err != nil {
+		t.Fatalf("unexpected error destroying machine: %s", err)
+	}
+	machines, err = driver.List()
+	if err != nil {
+		t.Fatalf("unexpected error listing machines: %s", err)
+	}
+	if len(machines) != 0 {
+		t.Fatalf("expected no machines after destroy, got %#v", machines)
+	}
+}
+
+func TestFakeInstanceDriverUnknownMachine(t *testing.T) {
+	driver := NewFakeInstanceDriver()
+	m, err := driver.Create(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating machine: %s", err)
+	}
+	other := *m
+	other.Id = "not-created"
+	if err = driver.Destroy(&other); err == nil {
+		t.Fatal("expected error destroying an unknown machine")
+	}
+	if err = driver.SetTags(&other, nil); err == nil {
+		t.Fatal("expected error tagging an unknown machine")
+	}
+}
+
+func TestGetInstanceDriverFakeIsSingleton(t *testing.T) {
+	first, err := getInstanceDriver("fake")
+	if err != nil {
+		t.Fatalf("unexpected error getting fake driver: %s", err)
+	}
+	m, err := first.Create(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating machine: %s", err)
+	}
+	defer first.Destroy(m)
+	second, err := getInstanceDriver("fake")
+	if err != nil {
+		t.Fatalf("unexpected error getting fake driver: %s", err)
+	}
+	found, err := findDriverMachine(second, m.Id, "")
+	if err != nil {
+		t.Fatalf("expected machine created through one lookup to be visible through another: %s", err)
+	}
+	if found.Id != m.Id {
+		t.Fatalf("expected to find machine %q, got %q", m.Id, found.Id)
+	}
+}
+
+func TestFindDriverMachine(t *testing.T) {
+	driver := NewFakeInstanceDriver()
+	m, err := driver.Create(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating machine: %s", err)
+	}
+	found, err := findDriverMachine(driver, m.Id, "")
+	if err != nil {
+		t.Fatalf("unexpected error finding machine by iaas id: %s", err)
+	}
+	if found.Id != m.Id {
+		t.Fatalf("expected to find machine %q, got %q", m.Id, found.Id)
+	}
+	found, err = findDriverMachine(driver, "", "fake-1.autoscale:2375")
+	if err != nil {
+		t.Fatalf("unexpected error finding machine by host: %s", err)
+	}
+	if found.Id != m.Id {
+		t.Fatalf("expected to find machine %q, got %q", m.Id, found.Id)
+	}
+	if _, err = findDriverMachine(driver, "unknown-id", "unknown-host"); err == nil {
+		t.Fatal("expected error finding a machine that doesn't exist")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/iaas"
+)
+
+// FakeInstanceDriver is an in-memory InstanceDriver meant to exercise the
+// autoscaler end-to-end without talking to a real IaaS. Register it as
+// the driver for a pool (config "docker:auto-scale:driver" or
+// "docker:auto-scale:driver:pools:<pool>" set to "fake") to use it.
+type FakeInstanceDriver struct {
+	mu       sync.Mutex
+	Machines map[string]*iaas.Machine
+	Tags     map[string]map[string]string
+	counter  int
+}
+
+// NewFakeInstanceDriver returns an empty FakeInstanceDriver ready to use.
+func NewFakeInstanceDriver() *FakeInstanceDriver {
+	return &FakeInstanceDriver{
+		Machines: map[string]*iaas.Machine{},
+		Tags:     map[string]map[string]string{},
+	}
+}
+
+func (d *FakeInstanceDriver) Create(metadata map[string]string) (*iaas.Machine, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counter++
+	m := &iaas.Machine{
+		Id:      fmt.Sprintf("fake-machine-%d", d.counter),
+		Address: fmt.Sprintf("http://fake-%d.autoscale:2375", d.counter),
+	}
+	d.Machines[m.Id] = m
+	return m, nil
+}
+
+func (d *FakeInstanceDriver) Destroy(m *iaas.Machine) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Machines[m.Id]; !ok {
+		return errors.Errorf("fake driver: machine %q not found", m.Id)
+	}
+	delete(d.Machines, m.Id)
+	delete(d.Tags, m.Id)
+	return nil
+}
+
+func (d *FakeInstanceDriver) List() ([]iaas.Machine, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	machines := make([]iaas.Machine, 0, len(d.Machines))
+	for _, m := range d.Machines {
+		machines = append(machines, *m)
+	}
+	return machines, nil
+}
+
+func (d *FakeInstanceDriver) Stop(m *iaas.Machine) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Machines[m.Id]; !ok {
+		return errors.Errorf("fake driver: machine %q not found", m.Id)
+	}
+	return nil
+}
+
+func (d *FakeInstanceDriver) SetTags(m *iaas.Machine, tags map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Machines[m.Id]; !ok {
+		return errors.Errorf("fake driver: machine %q not found", m.Id)
+	}
+	d.Tags[m.Id] = tags
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import "github.com/tsuru/tsuru/provision"
+
+// fakeNode is a minimal provision.Node implementing only the methods
+// this package actually calls on a node (Address, Pool, Metadata,
+// Units), enough to drive the scaler/planner logic under test without
+// pulling in a real provisioner.
+type fakeNode struct {
+	addr     string
+	pool     string
+	metadata map[string]string
+	units    []provision.Unit
+}
+
+func (n *fakeNode) Address() string {
+	return n.addr
+}
+
+func (n *fakeNode) Pool() string {
+	return n.pool
+}
+
+func (n *fakeNode) Metadata() map[string]string {
+	return n.metadata
+}
+
+func (n *fakeNode) Units() ([]provision.Unit, error) {
+	return n.units, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/tsuru/event"
+)
+
+// Metrics registered here are exposed on the same endpoint as the rest
+// of tsuru's Prometheus metrics (see api/metrics.go), turning the
+// previously free-text evt.Logf trail into something dashboards and
+// alerts can consume.
+var (
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsuru",
+		Subsystem: "autoscale",
+		Name:      "runs_total",
+		Help:      "Number of autoscale runs per pool.",
+	}, []string{"pool"})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsuru",
+		Subsystem: "autoscale",
+		Name:      "errors_total",
+		Help:      "Number of autoscale errors per pool and error kind.",
+	}, []string{"pool", "kind"})
+
+	nodesAddedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsuru",
+		Subsystem: "autoscale",
+		Name:      "nodes_added_total",
+		Help:      "Number of nodes added by the autoscaler per pool.",
+	}, []string{"pool"})
+
+	nodesRemovedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsuru",
+		Subsystem: "autoscale",
+		Name:      "nodes_removed_total",
+		Help:      "Number of nodes removed by the autoscaler per pool.",
+	}, []string{"pool"})
+
+	nodeCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tsuru",
+		Subsystem: "autoscale",
+		Name:      "node_create_duration_seconds",
+		Help:      "Time to create a new node through the configured InstanceDriver.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool"})
+
+	rebalanceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tsuru",
+		Subsystem: "autoscale",
+		Name:      "rebalance_duration_seconds",
+		Help:      "Time spent computing and applying a rebalance plan.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		runsTotal,
+		errorsTotal,
+		nodesAddedTotal,
+		nodesRemovedTotal,
+		nodeCreateDuration,
+		rebalanceDuration,
+	)
+}
+
+// errorKind categorizes an error for the errorsTotal counter without
+// leaking the (potentially high-cardinality) error message itself into
+// a metric label. Most errors reaching here went through errors.Wrap
+// somewhere on the way, so the underlying cause is unwrapped first;
+// without that, every wrapped error would fall into "other" and the
+// more specific cases below would never match.
+func errorKind(err error) string {
+	if err == nil {
+		return ""
+	}
+	switch errors.Cause(err).(type) {
+	case errAppNotLocked:
+		return "app_not_locked"
+	case event.ErrEventLocked:
+		return "event_locked"
+	default:
+		return "other"
+	}
+}
+
+func observeDuration(h *prometheus.HistogramVec, pool string, start time.Time) {
+	h.WithLabelValues(pool).Observe(time.Since(start).Seconds())
+}
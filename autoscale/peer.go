@@ -0,0 +1,246 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/provision"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Peer is a remote tsuru instance registered to peer with this one for
+// autoscale purposes. Pools present on both sides are treated as a
+// single federated pool: excess capacity on either side suppresses
+// scale-up on the other.
+type Peer struct {
+	Name      string `bson:"_id"`
+	Address   string
+	Token     string
+	CreatedAt time.Time
+}
+
+func peerCollection() (*db.Storage, func() error, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Close, nil
+}
+
+// issuedPeerToken is a token handed out by GenerateToken, kept around so
+// a later PoolStateHandler call can confirm the bearer token it receives
+// is one this instance actually issued, instead of trusting any token a
+// caller happens to present.
+type issuedPeerToken struct {
+	Token     string `bson:"_id"`
+	CreatedAt time.Time
+}
+
+// RegisterPeer stores peer so it's consulted on every following scaler
+// run. It's the second half of the peering handshake: the operator
+// generates a token on the remote side (GenerateToken) and calls
+// initiate here with that token.
+func RegisterPeer(peer *Peer) error {
+	if peer.Name == "" || peer.Address == "" || peer.Token == "" {
+		return errors.New("peer name, address and token are required")
+	}
+	conn, closer, err := peerCollection()
+	if err != nil {
+		return err
+	}
+	defer closer()
+	peer.CreatedAt = time.Now()
+	_, err = conn.Collection("autoscale_peer").UpsertId(peer.Name, peer)
+	return err
+}
+
+// RemovePeer forgets a previously registered peer.
+func RemovePeer(name string) error {
+	conn, closer, err := peerCollection()
+	if err != nil {
+		return err
+	}
+	defer closer()
+	return conn.Collection("autoscale_peer").RemoveId(name)
+}
+
+// ListPeers returns every peer registered with this instance.
+func ListPeers() ([]Peer, error) {
+	conn, closer, err := peerCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	var peers []Peer
+	err = conn.Collection("autoscale_peer").Find(bson.M{}).All(&peers)
+	return peers, err
+}
+
+// GenerateToken creates a fresh random token for a peer that's about to
+// initiate a handshake with this instance. The token must be handed to
+// the remote side out-of-band and is what they'll present back in the
+// initiate call. It's persisted so isKnownPeerToken can later confirm a
+// bearer token presented to PoolStateHandler was actually issued here.
+func GenerateToken() (string, error) {
+	token, err := generateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	conn, closer, err := peerCollection()
+	if err != nil {
+		return "", err
+	}
+	defer closer()
+	err = conn.Collection("autoscale_peer_token").Insert(issuedPeerToken{Token: token, CreatedAt: time.Now()})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to persist issued peer token")
+	}
+	return token, nil
+}
+
+// isIssuedPeerToken reports whether token was previously handed out by
+// GenerateToken.
+func isIssuedPeerToken(token string) bool {
+	conn, closer, err := peerCollection()
+	if err != nil {
+		return false
+	}
+	defer closer()
+	n, err := conn.Collection("autoscale_peer_token").FindId(token).Count()
+	return err == nil && n > 0
+}
+
+// PoolState is what a peer reports about one of its pools through the
+// peering API: its nodes, the rule governing it and how much spare
+// capacity it currently has. A positive SpareCapacity means the peer
+// could absorb that many more units before it would scale up itself; a
+// negative one means the peer itself needs more capacity.
+type PoolState struct {
+	Pool          string               `json:"pool"`
+	Nodes         []provision.NodeSpec `json:"nodes"`
+	Rule          *Rule                `json:"rule"`
+	SpareCapacity int                  `json:"spareCapacity"`
+}
+
+// poolStateForPeering builds the PoolState for pool as seen by this
+// instance, to be served to peers through the peering API.
+func (a *Config) poolStateForPeering(pool string, nodes []provision.Node) (*PoolState, error) {
+	rule, err := AutoScaleRuleForMetadata(pool)
+	if err != nil {
+		rule, err = AutoScaleRuleForMetadata("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	spare, err := a.peeringSpareCapacity(pool, rule, nodes)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolState{
+		Pool:          pool,
+		Nodes:         nodesToSpec(nodes),
+		Rule:          rule,
+		SpareCapacity: spare,
+	}, nil
+}
+
+// peeringSpareCapacity answers how much spare capacity pool has for a
+// peer's status query. For a MaxContainerCount rule it counts units
+// directly instead of going through scalerForRule/scale: that path runs
+// unitsGapInNodes, which acquires a real autoscale app lock per app in
+// the pool (see preciseUnitsByNode) to get a consistent gap for an
+// actual scaling decision. A read-only capacity poll answering a peer
+// doesn't need that consistency and must never contend with this
+// instance's own scaler run or with deploys over the same locks. The
+// other rule kinds (memory ratio, queue mode) don't acquire any lock in
+// their scale implementation, so they're left to go through the normal
+// scaler.
+func (a *Config) peeringSpareCapacity(pool string, rule *Rule, nodes []provision.Node) (int, error) {
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+	if rule.MaxContainerCount > 0 {
+		total := 0
+		for _, node := range nodes {
+			units, err := node.Units()
+			if err != nil {
+				return 0, err
+			}
+			total += len(units)
+		}
+		return rule.MaxContainerCount*len(nodes) - total, nil
+	}
+	scaler, err := a.scalerForRule(rule)
+	if err != nil {
+		return 0, err
+	}
+	sResult, err := scaler.scale(pool, nodes)
+	if err != nil {
+		return 0, err
+	}
+	return len(sResult.ToRemove) - sResult.ToAdd, nil
+}
+
+func fetchPeerPoolState(peer Peer, pool string) (*PoolState, error) {
+	url := fmt.Sprintf("%s/1.0/autoscale/peers/pools/%s", peer.Address, pool)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "bearer "+peer.Token)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status from peer %q: %d", peer.Name, resp.StatusCode)
+	}
+	var state PoolState
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// peerExcessCapacity asks every registered peer with nodes in pool how
+// much spare capacity they're carrying, and sums the positive amounts.
+// A peer that can't be reached or that's short on capacity itself is
+// simply skipped, it never blocks the local decision.
+func (a *Config) peerExcessCapacity(pool string, rule *Rule) (int, []string) {
+	if !rule.SharedAcrossPeers {
+		return 0, nil
+	}
+	peers, err := ListPeers()
+	if err != nil {
+		a.logError("unable to list autoscale peers: %s", err)
+		return 0, nil
+	}
+	total := 0
+	var consulted []string
+	for _, peer := range peers {
+		state, err := fetchPeerPoolState(peer, pool)
+		if err != nil {
+			a.logError("unable to fetch pool state from peer %q: %s", peer.Name, err)
+			continue
+		}
+		if len(state.Nodes) == 0 {
+			continue
+		}
+		consulted = append(consulted, peer.Name)
+		if state.SpareCapacity > 0 {
+			total += state.SpareCapacity
+		}
+	}
+	return total, consulted
+}
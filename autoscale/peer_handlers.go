@@ -0,0 +1,156 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/provision"
+)
+
+// These handlers back the peering handshake and the peering API
+// served to fetchPeerPoolState. They're plain http.HandlerFunc so the
+// api package can wire them into the router under a path such as
+// /1.0/autoscale/peers/*, the same way it wires up every other feature
+// package's handlers.
+
+func generateRandomToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to generate peer token")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// GenerateTokenHandler issues a fresh token that a remote tsuru
+// instance presents back to InitiateHandler to complete the peering
+// handshake. This is the first step, run on the side that will be
+// peered with. The token is not invalidated once used.
+func GenerateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := GenerateToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+type initiatePeerRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Token   string `json:"token"`
+}
+
+// InitiateHandler completes the peering handshake: it registers the
+// remote instance described in the request body as a Peer, to be
+// consulted on every following scaler run.
+func InitiateHandler(w http.ResponseWriter, r *http.Request) {
+	var req initiatePeerRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = RegisterPeer(&Peer{Name: req.Name, Address: req.Address, Token: req.Token})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ListPeersHandler lists the peers registered with this instance.
+func ListPeersHandler(w http.ResponseWriter, r *http.Request) {
+	peers, err := ListPeers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// PoolStateHandler serves this instance's PoolState for the pool in the
+// request path, authenticating the caller against the tokens issued by
+// GenerateToken and those of the registered peers. It's what fetchPeerPoolState on the other side talks to.
+func PoolStateHandler(w http.ResponseWriter, r *http.Request, pool string) {
+	if !isKnownPeerToken(bearerToken(r)) {
+		http.Error(w, "unknown or missing peer token", http.StatusUnauthorized)
+		return
+	}
+	conf, err := CurrentConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	provs, err := provision.Registry()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var nodes []provision.Node
+	for _, prov := range provs {
+		nodeProv, ok := prov.(provision.NodeProvisioner)
+		if !ok {
+			continue
+		}
+		poolNodes, err := nodeProv.ListNodes(nil)
+		if err != nil {
+			continue
+		}
+		for _, n := range poolNodes {
+			if n.Pool() == pool {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	state, err := conf.poolStateForPeering(pool, nodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+}
+
+func isKnownPeerToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	if isIssuedPeerToken(token) {
+		return true
+	}
+	peers, err := ListPeers()
+	if err != nil {
+		return false
+	}
+	for _, peer := range peers {
+		if tokensMatch(peer.Token, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokensMatch compares two peer tokens without leaking timing
+// information about how much of a guessed token matched.
+func tokensMatch(a, b string) bool {
+	return len(a) == len(b) && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
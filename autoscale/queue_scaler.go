@@ -0,0 +1,254 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsuru/tsuru/provision"
+)
+
+// PendingUnitsProvider reports, per pool, how many units the
+// provisioner wants to place but currently can't fit anywhere. The
+// queueScaler uses this to size the pool ahead of demand instead of
+// reacting to steady-state occupancy.
+type PendingUnitsProvider interface {
+	PendingUnits(pool string) (int, error)
+}
+
+var (
+	pendingUnitsProviderMu sync.RWMutex
+	pendingUnitsProvider   PendingUnitsProvider
+)
+
+// RegisterPendingUnitsProvider sets the provider consulted by every
+// queueScaler. Provisioners that can report a placement queue should
+// call this from their init().
+func RegisterPendingUnitsProvider(p PendingUnitsProvider) {
+	pendingUnitsProviderMu.Lock()
+	defer pendingUnitsProviderMu.Unlock()
+	pendingUnitsProvider = p
+}
+
+func currentPendingUnitsProvider() (PendingUnitsProvider, error) {
+	pendingUnitsProviderMu.RLock()
+	defer pendingUnitsProviderMu.RUnlock()
+	if pendingUnitsProvider == nil {
+		return nil, errNoPendingUnitsProvider{}
+	}
+	return pendingUnitsProvider, nil
+}
+
+type errNoPendingUnitsProvider struct{}
+
+func (errNoPendingUnitsProvider) Error() string {
+	return "no PendingUnitsProvider registered, queue mode autoscale rules can't run"
+}
+
+// nodeIdleSince tracks, per node address, when a node was first seen with
+// free capacity to spare in its current idle stretch; the entry is cleared
+// as soon as the node is seen without room. It's process-local: a scaler restart simply
+// resets the cooldown clock, which is safe since it only delays removal.
+var (
+	nodeIdleMu    sync.Mutex
+	nodeIdleSince = map[string]time.Time{}
+)
+
+// queueScaler scales a pool from the pending unit queue rather than from
+// the occupancy of existing nodes. It adds nodes ahead of demand when
+// PendingUnitsProvider reports units that don't fit anywhere, and
+// removes nodes that have had free capacity for longer than
+// rule.QueueIdleCooldown.
+type queueScaler struct {
+	*Config
+	rule *Rule
+}
+
+func (a *queueScaler) scale(pool string, nodes []provision.Node) (*ScalerResult, error) {
+	provider, err := currentPendingUnitsProvider()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := provider.PendingUnits(pool)
+	if err != nil {
+		return nil, err
+	}
+	nodeFrees, err := a.perNodeFreeCapacity(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		toAdd := a.nodesNeededFor(pending, nodeFrees)
+		if toAdd > 0 {
+			return &ScalerResult{
+				ToAdd:  toAdd,
+				Reason: "pending units queue requires additional capacity",
+			}, nil
+		}
+	}
+	idleCooldown := a.rule.QueueIdleCooldown
+	if idleCooldown <= 0 {
+		return &ScalerResult{}, nil
+	}
+	now := time.Now()
+	var toRemove []provision.Node
+	for i, node := range nodes {
+		addr := node.Address()
+		if nodeFrees[i].hasRoom {
+			since, ok := nodeIdleSince[addr]
+			if !ok {
+				setNodeIdleSince(addr, now)
+				continue
+			}
+			if now.Sub(since) >= idleCooldown {
+				toRemove = append(toRemove, node)
+			}
+		} else {
+			clearNodeIdleSince(addr)
+		}
+	}
+	if len(toRemove) == 0 {
+		return &ScalerResult{}, nil
+	}
+	// Only idle nodes are candidates, but whether one can go is judged
+	// against the whole pool, as chooseNodeForRemoval does.
+	var chosen []provision.Node
+	remaining := append([]provision.Node(nil), nodes...)
+	for _, node := range toRemove {
+		if canRemove, _ := canRemoveNode(node, remaining); !canRemove {
+			continue
+		}
+		for i := range remaining {
+			if remaining[i].Address() == node.Address() {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		chosen = append(chosen, node)
+	}
+	for _, node := range chosen {
+		clearNodeIdleSince(node.Address())
+	}
+	return &ScalerResult{
+		ToRemove: nodesToSpec(chosen),
+		Reason:   "node has had free capacity for longer than the rule's queue idle cooldown",
+	}, nil
+}
+
+// nodesNeededFor returns how many nodes must be added to place pending
+// units, given the free capacity already available across the pool and
+// the rule's configured unit-size profile. It assumes each new node has
+// as much free cpu/memory as the existing nodes have on average, and
+// counts at least one unit per new node.
+//
+// A unit can only land on a single node, so how many pending units
+// "fit" in the existing pool has to be the sum of whole units that fit
+// on each node individually, never the pool's aggregate free cpu/memory:
+// a pool of ten nodes each with half a unit free has zero room for a new
+// unit, even though the aggregate free capacity adds up to five units.
+func (a *queueScaler) nodesNeededFor(pending int, nodeFrees []nodeFree) int {
+	unitCPU := a.rule.QueueUnitCPU
+	unitMemory := a.rule.QueueUnitMemory
+	if unitCPU <= 0 && unitMemory <= 0 {
+		return 0
+	}
+	fit := 0
+	var totalFreeCPU int
+	var totalFreeMemory int64
+	for _, nf := range nodeFrees {
+		fit += unitsThatFit(nf.cpu, nf.memory, unitCPU, unitMemory)
+		totalFreeCPU += nf.cpu
+		totalFreeMemory += nf.memory
+	}
+	missing := pending - fit
+	nodeCount := len(nodeFrees)
+	if missing <= 0 || nodeCount == 0 {
+		return 0
+	}
+	avgCPU := totalFreeCPU / nodeCount
+	avgMemory := totalFreeMemory / int64(nodeCount)
+	unitsPerNewNode := unitsThatFit(avgCPU, avgMemory, unitCPU, unitMemory)
+	if unitsPerNewNode <= 0 {
+		unitsPerNewNode = 1
+	}
+	toAdd := missing / unitsPerNewNode
+	if missing%unitsPerNewNode != 0 {
+		toAdd++
+	}
+	return toAdd
+}
+
+// unitsThatFit returns how many unit-sized (cpu, memory) workloads fit
+// in the given amount of free cpu/memory.
+func unitsThatFit(freeCPU int, freeMemory int64, unitCPU int, unitMemory int64) int {
+	fit := -1
+	if unitCPU > 0 {
+		fit = freeCPU / unitCPU
+	}
+	if unitMemory > 0 {
+		memFit := int(freeMemory / unitMemory)
+		if fit == -1 || memFit < fit {
+			fit = memFit
+		}
+	}
+	if fit < 0 {
+		return 0
+	}
+	return fit
+}
+
+// nodeFree is a single node's free cpu/memory, as used by
+// perNodeFreeCapacity.
+type nodeFree struct {
+	addr    string
+	cpu     int
+	memory  int64
+	hasRoom bool
+}
+
+// perNodeFreeCapacity computes, for each node, how much cpu/memory it
+// has free and whether that's enough for at least one more unit-sized
+// workload. Callers that need a fit count must sum per node rather than
+// summing cpu/memory first: free capacity fragmented across many nodes
+// can't host a unit that needs to land on a single one of them.
+func (a *queueScaler) perNodeFreeCapacity(nodes []provision.Node) ([]nodeFree, error) {
+	result := make([]nodeFree, len(nodes))
+	for i, node := range nodes {
+		metadata := node.Metadata()
+		totalCPU, _ := strconv.Atoi(metadata[a.TotalCPUMetadata])
+		totalMemory, _ := strconv.ParseInt(metadata[a.TotalMemoryMetadata], 10, 64)
+		units, err := node.Units()
+		if err != nil {
+			return nil, err
+		}
+		usedCPU := len(units) * a.rule.QueueUnitCPU
+		usedMemory := int64(len(units)) * a.rule.QueueUnitMemory
+		freeCPU := totalCPU - usedCPU
+		freeMemory := totalMemory - usedMemory
+		hasRoom := true
+		if a.rule.QueueUnitCPU > 0 && freeCPU < a.rule.QueueUnitCPU {
+			hasRoom = false
+		}
+		if a.rule.QueueUnitMemory > 0 && freeMemory < a.rule.QueueUnitMemory {
+			hasRoom = false
+		}
+		result[i] = nodeFree{addr: node.Address(), cpu: freeCPU, memory: freeMemory, hasRoom: hasRoom}
+	}
+	return result, nil
+}
+
+func setNodeIdleSince(addr string, t time.Time) {
+	nodeIdleMu.Lock()
+	defer nodeIdleMu.Unlock()
+	nodeIdleSince[addr] = t
+}
+
+func clearNodeIdleSince(addr string) {
+	nodeIdleMu.Lock()
+	defer nodeIdleMu.Unlock()
+	delete(nodeIdleSince, addr)
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"testing"
+
+	"github.com/tsuru/tsuru/provision"
+)
+
+// twoNodesWithFragmentedCapacity returns two nodes with 16 total cpu and
+// one 10-cpu unit already placed on each, leaving 6 free cpu per node:
+// less than the 10-cpu unit size on either node alone, but 12 in
+// aggregate across the pair.
+func twoNodesWithFragmentedCapacity(scaler *queueScaler) []provision.Node {
+	unit := provision.Unit{}
+	return []provision.Node{
+		&fakeNode{addr: "node1", metadata: map[string]string{
+			scaler.TotalCPUMetadata: "16",
+		}, units: []provision.Unit{unit}},
+		&fakeNode{addr: "node2", metadata: map[string]string{
+			scaler.TotalCPUMetadata: "16",
+		}, units: []provision.Unit{unit}},
+	}
+}
+
+// TestPerNodeFreeCapacityFragmented covers the case that broke the old
+// aggregate-then-divide math: two nodes each with 6 free cpu add up to
+// 12, more than the 10-cpu unit size, but no single node has room for
+// the whole unit.
+func TestPerNodeFreeCapacityFragmented(t *testing.T) {
+	scaler := &queueScaler{
+		Config: &Config{TotalCPUMetadata: "totalCpu"},
+		rule:   &Rule{QueueUnitCPU: 10},
+	}
+	nodes := twoNodesWithFragmentedCapacity(scaler)
+	frees, err := scaler.perNodeFreeCapacity(nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, nf := range frees {
+		if nf.cpu != 6 {
+			t.Fatalf("expected 6 free cpu per node, got %d", nf.cpu)
+		}
+		if nf.hasRoom {
+			t.Fatalf("expected node %q with only 6 free cpu to have no room for a 10-cpu unit", nf.addr)
+		}
+	}
+}
+
+// TestNodesNeededForFragmentedCapacity is the regression test for the
+// bug fixed in 6a1deff: summing free cpu across nodes before dividing by
+// the unit size says a pending unit already fits (6+6=12 >= 10) even
+// though it would need to land on one node that only has 6 free. Once
+// fit is computed per node first, the fragmented pool correctly reports
+// it needs a new node.
+func TestNodesNeededForFragmentedCapacity(t *testing.T) {
+	scaler := &queueScaler{
+		Config: &Config{TotalCPUMetadata: "totalCpu"},
+		rule:   &Rule{QueueUnitCPU: 10},
+	}
+	nodes := twoNodesWithFragmentedCapacity(scaler)
+	frees, err := scaler.perNodeFreeCapacity(nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if toAdd := scaler.nodesNeededFor(1, frees); toAdd != 1 {
+		t.Fatalf("expected 1 node to be added for a pending unit that fits nowhere, got %d", toAdd)
+	}
+}
+
+func TestNodesNeededForAlreadyFits(t *testing.T) {
+	scaler := &queueScaler{
+		Config: &Config{TotalCPUMetadata: "totalCpu"},
+		rule:   &Rule{QueueUnitCPU: 10},
+	}
+	nodes := []provision.Node{
+		&fakeNode{addr: "node1", metadata: map[string]string{"totalCpu": "20"}},
+	}
+	frees, err := scaler.perNodeFreeCapacity(nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if toAdd := scaler.nodesNeededFor(1, frees); toAdd != 0 {
+		t.Fatalf("expected no node to be added when an existing node already fits the pending unit, got %d", toAdd)
+	}
+}
+
+type fakePendingUnitsProvider struct {
+	pending int
+}
+
+func (p *fakePendingUnitsProvider) PendingUnits(pool string) (int, error) {
+	return p.pending, nil
+}
+
+// TestQueueScalerScaleFragmentedCapacity drives the fix end to end
+// through queueScaler.scale: a pool whose free capacity is fragmented
+// across nodes must ask for a new node instead of reporting the pending
+// unit already fits.
+func TestQueueScalerScaleFragmentedCapacity(t *testing.T) {
+	RegisterPendingUnitsProvider(&fakePendingUnitsProvider{pending: 1})
+	defer RegisterPendingUnitsProvider(nil)
+	scaler := &queueScaler{
+		Config: &Config{TotalCPUMetadata: "totalCpu"},
+		rule:   &Rule{QueueUnitCPU: 10},
+	}
+	nodes := twoNodesWithFragmentedCapacity(scaler)
+	result, err := scaler.scale("mypool", nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.ToAdd != 1 {
+		t.Fatalf("expected scale to add 1 node for a pending unit that fits nowhere, got ToAdd=%d", result.ToAdd)
+	}
+}
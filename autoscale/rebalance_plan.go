@@ -0,0 +1,275 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/provision"
+)
+
+// RebalanceMove is a single "move this unit to another node" step of a
+// RebalancePlan.
+type RebalanceMove struct {
+	Unit     provision.Unit
+	FromNode string
+	ToNode   string
+}
+
+// RebalancePlan is the explicit, diffable result of running the bin
+// packing planner against the current placement. MaxLoad/MinLoad are the
+// load ratios (used/total capacity) of the most and least loaded nodes
+// in the current placement, before any move, which is what
+// RebalanceTolerance is compared against.
+type RebalancePlan struct {
+	Moves   []RebalanceMove
+	MaxLoad float64
+	MinLoad float64
+}
+
+type nodeCapacity struct {
+	node        provision.Node
+	usedCPU     int
+	totalCPU    int
+	usedMemory  int64
+	totalMemory int64
+}
+
+// hasCapacity reports whether this node advertised a total cpu or
+// memory figure through its metadata. Nodes without either are of
+// unknown size and must never be treated as having free room: that
+// would turn them into a silent sink for every unit in the pool.
+func (n *nodeCapacity) hasCapacity() bool {
+	return n.totalCPU > 0 || n.totalMemory > 0
+}
+
+func (n *nodeCapacity) load() float64 {
+	if n.totalMemory > 0 {
+		return float64(n.usedMemory) / float64(n.totalMemory)
+	}
+	if n.totalCPU > 0 {
+		return float64(n.usedCPU) / float64(n.totalCPU)
+	}
+	return 0
+}
+
+func (n *nodeCapacity) fits(u sizedUnit) bool {
+	if !n.hasCapacity() {
+		return false
+	}
+	if n.totalCPU > 0 && n.usedCPU+u.cpu > n.totalCPU {
+		return false
+	}
+	if n.totalMemory > 0 && n.usedMemory+u.memory > n.totalMemory {
+		return false
+	}
+	return true
+}
+
+type sizedUnit struct {
+	unit      provision.Unit
+	fromNode  string
+	appName   string
+	cpu       int
+	memory    int64
+	exclusive map[string]string
+}
+
+// computeRebalancePlan builds an explicit move plan for pool: it vectors
+// out used/total cpu+memory per node, sorts units by decreasing size and
+// runs first-fit-decreasing to place each one on the least loaded node
+// that satisfies app anti-affinity and pool metadata exclusivity. The
+// diff between that placement and the current one is the plan; when the
+// max/min load gap is already within rule.RebalanceTolerance the plan is
+// empty and nothing is handed to the provisioner.
+func (a *Config) computeRebalancePlan(pool string, rule *Rule, nodes []provision.Node) (*RebalancePlan, error) {
+	unitsByNode, err := preciseUnitsByNode(pool, nodes)
+	if err != nil {
+		return nil, err
+	}
+	exclusiveList, _, err := provision.NodeList(nodes).SplitMetadata()
+	if err != nil {
+		return nil, err
+	}
+	capacities := map[string]*nodeCapacity{}
+	for _, node := range nodes {
+		metadata := node.Metadata()
+		totalCPU, _ := strconv.Atoi(metadata[a.TotalCPUMetadata])
+		totalMemory, _ := strconv.ParseInt(metadata[a.TotalMemoryMetadata], 10, 64)
+		capacities[node.Address()] = &nodeCapacity{
+			node:        node,
+			totalCPU:    totalCPU,
+			totalMemory: totalMemory,
+		}
+	}
+	exclusiveMetadataByApp := map[string]map[string]string{}
+	for _, group := range exclusiveList {
+		for _, n := range group.Nodes {
+			for _, u := range mustUnits(n) {
+				exclusiveMetadataByApp[u.AppName] = group.Metadata
+			}
+		}
+	}
+	var units []sizedUnit
+	for addr, nodeUnits := range unitsByNode {
+		for _, u := range nodeUnits {
+			cpu, memory := unitSize(u)
+			nc := capacities[addr]
+			if nc != nil {
+				nc.usedCPU += cpu
+				nc.usedMemory += memory
+			}
+			units = append(units, sizedUnit{
+				unit:      u,
+				fromNode:  addr,
+				appName:   u.AppName,
+				cpu:       cpu,
+				memory:    memory,
+				exclusive: exclusiveMetadataByApp[u.AppName],
+			})
+		}
+	}
+	if !anyKnownCapacity(capacities) {
+		return &RebalancePlan{}, nil
+	}
+	maxLoad, minLoad := loadGap(capacities)
+	if rule.RebalanceTolerance > 0 && maxLoad-minLoad <= rule.RebalanceTolerance {
+		return &RebalancePlan{MaxLoad: maxLoad, MinLoad: minLoad}, nil
+	}
+	sort.Slice(units, func(i, j int) bool {
+		if units[i].memory != units[j].memory {
+			return units[i].memory > units[j].memory
+		}
+		return units[i].cpu > units[j].cpu
+	})
+	placement := map[string]string{}
+	totalUnitsPerApp := map[string]int{}
+	for _, u := range units {
+		totalUnitsPerApp[u.appName]++
+	}
+	freedUsage := map[string]*nodeCapacity{}
+	for addr, nc := range capacities {
+		freedUsage[addr] = &nodeCapacity{totalCPU: nc.totalCPU, totalMemory: nc.totalMemory}
+	}
+	assignedCountOnNode := map[string]map[string]int{}
+	for addr := range capacities {
+		assignedCountOnNode[addr] = map[string]int{}
+	}
+	for _, u := range units {
+		target := bestFitNode(u, nodes, freedUsage, assignedCountOnNode, totalUnitsPerApp)
+		if target == "" {
+			target = u.fromNode
+		}
+		placement[u.unit.ID] = target
+		freedUsage[target].usedCPU += u.cpu
+		freedUsage[target].usedMemory += u.memory
+		assignedCountOnNode[target][u.appName]++
+	}
+	var moves []RebalanceMove
+	for _, u := range units {
+		to := placement[u.unit.ID]
+		if to == u.fromNode {
+			continue
+		}
+		moves = append(moves, RebalanceMove{Unit: u.unit, FromNode: u.fromNode, ToNode: to})
+	}
+	return &RebalancePlan{Moves: moves, MaxLoad: maxLoad, MinLoad: minLoad}, nil
+}
+
+// bestFitNode returns the least loaded node able to host u without
+// breaking same-app anti-affinity (when the app has more than one unit)
+// or pool metadata exclusivity.
+func bestFitNode(u sizedUnit, nodes []provision.Node, usage map[string]*nodeCapacity, assignedCount map[string]map[string]int, totalUnitsPerApp map[string]int) string {
+	var best string
+	bestLoad := -1.0
+	for _, node := range nodes {
+		addr := node.Address()
+		nc := usage[addr]
+		if nc == nil {
+			continue
+		}
+		if len(u.exclusive) > 0 && !hasMetadata(node, u.exclusive) {
+			continue
+		}
+		if totalUnitsPerApp[u.appName] > 1 && assignedCount[addr][u.appName] > 0 {
+			continue
+		}
+		if !nc.fits(u) {
+			continue
+		}
+		load := nc.load()
+		if bestLoad < 0 || load < bestLoad {
+			bestLoad = load
+			best = addr
+		}
+	}
+	return best
+}
+
+func hasMetadata(n provision.Node, meta map[string]string) bool {
+	metadata := n.Metadata()
+	for k, v := range meta {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func mustUnits(n provision.Node) []provision.Unit {
+	units, err := n.Units()
+	if err != nil {
+		return nil
+	}
+	return units
+}
+
+// anyKnownCapacity reports whether at least one node in the pool
+// advertised its size. Planning against a pool where no node has known
+// capacity would let bestFitNode reject every target, so the caller
+// bails out before that happens rather than producing a plan that can
+// never place anything.
+func anyKnownCapacity(capacities map[string]*nodeCapacity) bool {
+	for _, nc := range capacities {
+		if nc.hasCapacity() {
+			return true
+		}
+	}
+	return false
+}
+
+func loadGap(capacities map[string]*nodeCapacity) (float64, float64) {
+	max := 0.0
+	min := -1.0
+	for _, nc := range capacities {
+		if !nc.hasCapacity() {
+			continue
+		}
+		load := nc.load()
+		if load > max {
+			max = load
+		}
+		if min < 0 || load < min {
+			min = load
+		}
+	}
+	if min < 0 {
+		min = 0
+	}
+	return max, min
+}
+
+// unitSize returns the (cpu, memory) footprint of a unit. tsuru units
+// don't carry their own resource usage, so this falls back to the app's
+// plan, which is what actually reserves capacity on the node.
+func unitSize(u provision.Unit) (int, int64) {
+	a, err := app.GetByName(u.AppName)
+	if err != nil {
+		return 1, 0
+	}
+	return a.Plan.CpuShare, a.Plan.Memory
+}
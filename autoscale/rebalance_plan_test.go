@@ -0,0 +1,93 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"testing"
+
+	"github.com/tsuru/tsuru/provision"
+)
+
+func TestComputeRebalancePlanSkipsWithinTolerance(t *testing.T) {
+	clearCollection(t, "apps")
+	a := &Config{TotalCPUMetadata: "totalCpu"}
+	rule := &Rule{RebalanceTolerance: 1}
+	nodes := []provision.Node{
+		&fakeNode{addr: "node1", metadata: map[string]string{"totalCpu": "4"}, units: []provision.Unit{
+			{ID: "u1", AppName: "appA"}, {ID: "u2", AppName: "appA"}, {ID: "u3", AppName: "appA"},
+		}},
+		&fakeNode{addr: "node2", metadata: map[string]string{"totalCpu": "4"}},
+	}
+	plan, err := a.computeRebalancePlan("rebalance-test-pool", rule, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(plan.Moves) != 0 {
+		t.Fatalf("expected no moves when the load gap is within RebalanceTolerance, got %#v", plan.Moves)
+	}
+}
+
+// TestComputeRebalancePlanMovesWhenImbalanced has a fully loaded node and
+// an empty one. It should produce a move, but anti-affinity (no node is
+// assigned a second unit of an app that has more than one) limits it to
+// moving only one of the three same-app units; the third has no eligible
+// node and stays where it is.
+func TestComputeRebalancePlanMovesWhenImbalanced(t *testing.T) {
+	clearCollection(t, "apps")
+	a := &Config{TotalCPUMetadata: "totalCpu"}
+	rule := &Rule{}
+	nodes := []provision.Node{
+		&fakeNode{addr: "node1", metadata: map[string]string{"totalCpu": "4"}, units: []provision.Unit{
+			{ID: "u1", AppName: "appA"}, {ID: "u2", AppName: "appA"}, {ID: "u3", AppName: "appA"},
+		}},
+		&fakeNode{addr: "node2", metadata: map[string]string{"totalCpu": "4"}},
+	}
+	plan, err := a.computeRebalancePlan("rebalance-test-pool", rule, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(plan.Moves) != 1 {
+		t.Fatalf("expected anti-affinity to limit the plan to a single move, got %#v", plan.Moves)
+	}
+	if plan.Moves[0].FromNode != "node1" || plan.Moves[0].ToNode != "node2" {
+		t.Fatalf("expected the move to go from node1 to node2, got %#v", plan.Moves[0])
+	}
+}
+
+func TestBestFitNodeRespectsAntiAffinity(t *testing.T) {
+	nodes := []provision.Node{
+		&fakeNode{addr: "node1"},
+		&fakeNode{addr: "node2"},
+	}
+	usage := map[string]*nodeCapacity{
+		"node1": {totalCPU: 10, usedCPU: 1},
+		"node2": {totalCPU: 10, usedCPU: 5},
+	}
+	assignedCount := map[string]map[string]int{
+		"node1": {"appA": 1},
+		"node2": {},
+	}
+	u := sizedUnit{appName: "appA", cpu: 1}
+	target := bestFitNode(u, nodes, usage, assignedCount, map[string]int{"appA": 2})
+	if target != "node2" {
+		t.Fatalf("expected anti-affinity to route a second appA unit to node2 despite its higher load, got %q", target)
+	}
+}
+
+func TestBestFitNodeRespectsExclusiveMetadata(t *testing.T) {
+	nodes := []provision.Node{
+		&fakeNode{addr: "node1", metadata: map[string]string{"pool-group": "other"}},
+		&fakeNode{addr: "node2", metadata: map[string]string{"pool-group": "restricted"}},
+	}
+	usage := map[string]*nodeCapacity{
+		"node1": {totalCPU: 10},
+		"node2": {totalCPU: 10},
+	}
+	u := sizedUnit{appName: "appA", cpu: 1, exclusive: map[string]string{"pool-group": "restricted"}}
+	target := bestFitNode(u, nodes, usage, map[string]map[string]int{}, map[string]int{"appA": 1})
+	if target != "node2" {
+		t.Fatalf("expected the unit requiring pool-group=restricted to land on node2, got %q", target)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"time"
+
+	"github.com/tsuru/tsuru/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Rule configures how the autoscaler behaves for a given pool. A Rule
+// with an empty MetadataFilter is the default, applied to pools with no
+// rule of their own.
+type Rule struct {
+	MetadataFilter    string `bson:"_id"`
+	Enabled           bool
+	MaxContainerCount int
+	MaxMemoryRatio    float32
+	ScaleDownRatio    float32
+	PreventRebalance  bool
+	// QueueMode selects the queueScaler instead of the reactive
+	// countScaler/memoryScaler, sizing the pool from pending units
+	// rather than steady-state occupancy.
+	QueueMode bool
+	// QueueUnitCPU and QueueUnitMemory describe the shape of a single
+	// pending unit, used by the queueScaler to size new nodes.
+	QueueUnitCPU      int
+	QueueUnitMemory   int64
+	QueueIdleCooldown time.Duration
+	// SharedAcrossPeers makes this pool's scale-up decisions take spare
+	// capacity reported by registered peers (see Peer) into account,
+	// federating pools with the same MetadataFilter across clusters.
+	SharedAcrossPeers bool
+	// RebalanceTolerance is the maximum allowed difference, as a
+	// fraction of a node's total capacity, between the most and least
+	// loaded node before a rebalance plan is computed. Zero means any
+	// gap triggers a rebalance.
+	RebalanceTolerance float64
+}
+
+func autoScaleRuleCollection() (*db.Storage, *mgo.Collection, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Collection("autoscale_rule"), nil
+}
+
+// AutoScaleRuleForMetadata fetches the rule registered for the given pool
+// metadata, returning mgo.ErrNotFound when none exists so callers can
+// fall back to the default rule.
+func AutoScaleRuleForMetadata(metadata string) (*Rule, error) {
+	conn, coll, err := autoScaleRuleCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var rule Rule
+	err = coll.FindId(metadata).One(&rule)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// AutoScaleRuleUpdate persists rule, creating or replacing the entry for
+// its MetadataFilter.
+func AutoScaleRuleUpdate(rule *Rule) error {
+	conn, coll, err := autoScaleRuleCollection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = coll.UpsertId(rule.MetadataFilter, rule)
+	return err
+}
+
+// ListAutoScaleRules returns every configured rule, including the
+// default one if present.
+func ListAutoScaleRules() ([]Rule, error) {
+	conn, coll, err := autoScaleRuleCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var rules []Rule
+	err = coll.Find(bson.M{}).All(&rules)
+	return rules, err
+}
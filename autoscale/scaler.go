@@ -0,0 +1,93 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"strconv"
+
+	"github.com/tsuru/tsuru/provision"
+)
+
+// countScaler scales a pool based on the gap between the most and least
+// loaded nodes, measured in number of units, and on an absolute maximum
+// of units per node.
+type countScaler struct {
+	*Config
+	rule *Rule
+}
+
+func (a *countScaler) scale(pool string, nodes []provision.Node) (*ScalerResult, error) {
+	totalCount, gap, err := unitsGapInNodes(pool, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return &ScalerResult{}, nil
+	}
+	freeSlots := a.rule.MaxContainerCount*len(nodes) - totalCount
+	if freeSlots < 0 {
+		return &ScalerResult{
+			ToAdd:  1,
+			Reason: "number of free slots is negative",
+		}, nil
+	}
+	if gap > a.rule.MaxContainerCount {
+		toRemove := chooseNodeForRemoval(nodes, 1)
+		return &ScalerResult{
+			ToRemove: nodesToSpec(toRemove),
+			Reason:   "gap between nodes is bigger than the rule's max container count",
+		}, nil
+	}
+	return &ScalerResult{}, nil
+}
+
+// memoryScaler scales a pool based on the ratio of memory already
+// committed to units against the total memory advertised by the nodes
+// (via Config.TotalMemoryMetadata).
+type memoryScaler struct {
+	*Config
+	rule *Rule
+}
+
+func (a *memoryScaler) scale(pool string, nodes []provision.Node) (*ScalerResult, error) {
+	if len(nodes) == 0 || a.rule.MaxMemoryRatio <= 0 {
+		return &ScalerResult{}, nil
+	}
+	var totalMemory, usedMemory float64
+	for _, node := range nodes {
+		metadata := node.Metadata()
+		if v, ok := metadata[a.TotalMemoryMetadata]; ok {
+			if nodeTotal, err := strconv.ParseFloat(v, 64); err == nil {
+				totalMemory += nodeTotal
+			}
+		}
+		units, err := node.Units()
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range units {
+			_, unitMemory := unitSize(u)
+			usedMemory += float64(unitMemory)
+		}
+	}
+	if totalMemory == 0 {
+		return &ScalerResult{}, nil
+	}
+	ratio := usedMemory / totalMemory
+	if ratio > float64(a.rule.MaxMemoryRatio) {
+		return &ScalerResult{
+			ToAdd:  1,
+			Reason: "memory usage ratio is bigger than the rule's max memory ratio",
+		}, nil
+	}
+	if a.rule.ScaleDownRatio > 0 && ratio < float64(a.rule.MaxMemoryRatio)/float64(a.rule.ScaleDownRatio) && len(nodes) > 1 {
+		toRemove := chooseNodeForRemoval(nodes, 1)
+		return &ScalerResult{
+			ToRemove: nodesToSpec(toRemove),
+			Reason:   "memory usage ratio is smaller than the rule's scale down threshold",
+		}, nil
+	}
+	return &ScalerResult{}, nil
+}
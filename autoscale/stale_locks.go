@@ -0,0 +1,89 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/event"
+)
+
+const defaultStaleLockMaxAge = 30 * time.Minute
+
+// fixStaleLocks clears locks left behind by a scaler that crashed or was
+// killed mid-run: running autoscale events whose heartbeat stopped being
+// renewed, and application locks acquired by the autoscaler that were
+// never released. It's meant to run once before every scaler iteration,
+// so a dead process never blocks progress until someone notices and
+// intervenes by hand.
+func (a *Config) fixStaleLocks() {
+	maxAge := staleLockMaxAge()
+	if err := fixStaleEventLocks(maxAge); err != nil {
+		a.logError("unable to fix stale event locks: %s", err)
+	}
+	if err := fixStaleAppLocks(maxAge); err != nil {
+		a.logError("unable to fix stale app locks: %s", err)
+	}
+}
+
+func staleLockMaxAge() time.Duration {
+	seconds, _ := config.GetInt("docker:auto-scale:stale-lock-max-age")
+	if seconds <= 0 {
+		return defaultStaleLockMaxAge
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// fixStaleEventLocks looks for running autoscale events whose lock
+// heartbeat hasn't been renewed in maxAge, meaning the process that
+// created them is gone, and force-finishes them so a new event can be
+// created for the same pool.
+func fixStaleEventLocks(maxAge time.Duration) error {
+	running := true
+	evts, err := event.List(&event.Filter{
+		KindType: event.KindTypeInternal,
+		KindName: EventKind,
+		Running:  &running,
+	})
+	if err != nil {
+		return err
+	}
+	for i := range evts {
+		evt := &evts[i]
+		if time.Since(evt.LockUpdateTime) < maxAge {
+			continue
+		}
+		err = evt.Done(errors.Errorf("lock reaped: no heartbeat for over %s, owning process is presumed dead", maxAge))
+		if err != nil {
+			return errors.Wrapf(err, "unable to reap stale event lock %s", evt.UniqueID.Hex())
+		}
+	}
+	return nil
+}
+
+// fixStaleAppLocks releases app locks held by the autoscaler for longer
+// than maxAge. A normal run always releases the lock it acquires via a
+// deferred app.ReleaseApplicationLock; this only matters when the
+// process died before the deferred call ran.
+func fixStaleAppLocks(maxAge time.Duration) error {
+	apps, err := app.List(nil)
+	if err != nil {
+		return err
+	}
+	for _, a := range apps {
+		lock := a.GetLock()
+		if !lock.Locked || lock.Owner != app.InternalAppName || lock.Reason != "node auto scale" {
+			continue
+		}
+		if time.Since(lock.AcquireDate) < maxAge {
+			continue
+		}
+		app.ReleaseApplicationLock(a.Name)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoscale
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/dbtest"
+	"github.com/tsuru/tsuru/event"
+	"github.com/tsuru/tsuru/permission"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var dbServer dbtest.DBServer
+
+func TestMain(m *testing.M) {
+	dbServer.SetPath("testdata_autoscale_stale_locks")
+	config.Set("database:url", dbServer.URL())
+	config.Set("database:name", "autoscale_stale_locks_tests")
+	code := m.Run()
+	dbServer.Stop()
+	os.Exit(code)
+}
+
+func TestStaleLockMaxAgeDefault(t *testing.T) {
+	config.Unset("docker:auto-scale:stale-lock-max-age")
+	if age := staleLockMaxAge(); age != defaultStaleLockMaxAge {
+		t.Fatalf("expected default stale lock max age %s, got %s", defaultStaleLockMaxAge, age)
+	}
+}
+
+func TestStaleLockMaxAgeConfigured(t *testing.T) {
+	config.Set("docker:auto-scale:stale-lock-max-age", 60)
+	defer config.Unset("docker:auto-scale:stale-lock-max-age")
+	if age := staleLockMaxAge(); age != time.Minute {
+		t.Fatalf("expected configured stale lock max age %s, got %s", time.Minute, age)
+	}
+}
+
+func clearCollection(t *testing.T, name string) {
+	conn, err := db.Conn()
+	if err != nil {
+		t.Fatalf("unexpected error connecting to db: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Collection(name).RemoveAll(bson.M{}); err != nil {
+		t.Fatalf("unexpected error clearing collection %q: %s", name, err)
+	}
+}
+
+// TestFixStaleEventLocksRecoversFromKilledScaler simulates a scaler that
+// was killed mid-run: it creates a real running autoscale event and
+// never finishes it, exactly like a process that died between acquiring
+// the lock and the deferred Done/Abort call. fixStaleEventLocks must
+// reap it once its heartbeat is older than maxAge, so the next cycle can
+// create a fresh event for the same pool instead of seeing it as busy.
+func TestFixStaleEventLocksRecoversFromKilledScaler(t *testing.T) {
+	clearCollection(t, "events")
+	pool := "mypool"
+	_, err := event.NewInternal(&event.Opts{
+		Target:       event.Target{Type: event.TargetTypePool, Value: pool},
+		InternalKind: EventKind,
+		Allowed:      event.Allowed(permission.PermPoolReadEvents, permission.Context(permission.CtxPool, pool)),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating event: %s", err)
+	}
+	running := true
+	evts, err := event.List(&event.Filter{KindType: event.KindTypeInternal, KindName: EventKind, Running: &running})
+	if err != nil || len(evts) != 1 {
+		t.Fatalf("expected exactly one running event before the reap, got %d (err: %v)", len(evts), err)
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		t.Fatalf("unexpected error connecting to db: %s", err)
+	}
+	defer conn.Close()
+	err = conn.Collection("events").UpdateId(evts[0].UniqueID, bson.M{
+		"$set": bson.M{"lockupdatetime": time.Now().Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error backdating the event heartbeat: %s", err)
+	}
+	if err = fixStaleEventLocks(time.Minute); err != nil {
+		t.Fatalf("unexpected error reaping stale event locks: %s", err)
+	}
+	evts, err = event.List(&event.Filter{KindType: event.KindTypeInternal, KindName: EventKind, Running: &running})
+	if err != nil {
+		t.Fatalf("unexpected error listing events after the reap: %s", err)
+	}
+	if len(evts) != 0 {
+		t.Fatalf("expected the stale event to be finished by the reap, still running: %#v", evts)
+	}
+}
+
+// TestFixStaleAppLocksReleasesAbandonedLock simulates the other half of
+// a killed scaler: an app lock acquired by preciseUnitsByNode that was
+// never released because the process died before the deferred
+// app.ReleaseApplicationLock ran. fixStaleAppLocks must release it once
+// it's older than maxAge.
+func TestFixStaleAppLocksReleasesAbandonedLock(t *testing.T) {
+	clearCollection(t, "apps")
+	appName := "myapp"
+	conn, err := db.Conn()
+	if err != nil {
+		t.Fatalf("unexpected error connecting to db: %s", err)
+	}
+	defer conn.Close()
+	err = conn.Collection("apps").Insert(bson.M{"name": appName})
+	if err != nil {
+		t.Fatalf("unexpected error inserting app: %s", err)
+	}
+	locked, err := app.AcquireApplicationLock(appName, app.InternalAppName, "node auto scale")
+	if err != nil || !locked {
+		t.Fatalf("unexpected error acquiring app lock: locked=%v err=%v", locked, err)
+	}
+	err = conn.Collection("apps").Update(bson.M{"name": appName}, bson.M{
+		"$set": bson.M{"lock.acquiredate": time.Now().Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error backdating the app lock: %s", err)
+	}
+	if err = fixStaleAppLocks(time.Minute); err != nil {
+		t.Fatalf("unexpected error reaping stale app locks: %s", err)
+	}
+	a, err := app.GetByName(appName)
+	if err != nil {
+		t.Fatalf("unexpected error fetching app: %s", err)
+	}
+	if a.GetLock().Locked {
+		t.Fatal("expected the abandoned app lock to be released by the reap")
+	}
+}